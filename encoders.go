@@ -0,0 +1,602 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/hamba/avro/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// MarshalerConfig bundles every option the marshaler factories need; each
+// factory reads only the fields relevant to it.
+type MarshalerConfig struct {
+	EmitDefaults  bool
+	UseProtoNames bool
+	Indent        string
+	AvroSchema    string // path to a .avsc file; empty derives the schema from the message descriptor
+}
+
+// MarshalerFactory builds a Marshaler from a MarshalerConfig.
+type MarshalerFactory func(cfg MarshalerConfig) (Marshaler, error)
+
+var marshalerFactories = map[string]MarshalerFactory{}
+
+func RegisterMarshalerFactory(name string, factory MarshalerFactory) {
+	marshalerFactories[name] = factory
+}
+
+// NewMarshaler looks up name in the registry and builds a Marshaler from cfg.
+func NewMarshaler(name string, cfg MarshalerConfig) (Marshaler, error) {
+	factory, ok := marshalerFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("invalid marshaler name:%v", name)
+	}
+	return factory(cfg)
+}
+
+func init() {
+	RegisterMarshalerFactory("json", func(cfg MarshalerConfig) (Marshaler, error) {
+		return NewProtoJsonMarshaler(cfg.EmitDefaults, cfg.UseProtoNames, cfg.Indent), nil
+	})
+	RegisterMarshalerFactory("prototext", func(cfg MarshalerConfig) (Marshaler, error) {
+		return &PrototextMarshaler{opts: prototext.MarshalOptions{EmitUnknown: false, Multiline: 0 != len(cfg.Indent)}}, nil
+	})
+	RegisterMarshalerFactory("cbor", func(cfg MarshalerConfig) (Marshaler, error) {
+		return &CBORMarshaler{}, nil
+	})
+	RegisterMarshalerFactory("msgpack", func(cfg MarshalerConfig) (Marshaler, error) {
+		return &MsgpackMarshaler{}, nil
+	})
+	RegisterMarshalerFactory("avro", func(cfg MarshalerConfig) (Marshaler, error) {
+		return NewAvroMarshaler(cfg.AvroSchema)
+	})
+}
+
+// PrototextMarshaler renders the decoded proto.Message field of the row with
+// prototext, directly off the dynamicpb.Message, rather than through the
+// lossy map that the old convertToMap produced. Other CSV columns are
+// appended as plain "key: value" lines.
+type PrototextMarshaler struct {
+	opts prototext.MarshalOptions
+}
+
+func (m *PrototextMarshaler) Marshal(row map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(row))
+	for k := range row {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		v := row[k]
+		if msg, ok := v.(proto.Message); ok {
+			fmt.Fprintf(&buf, "%s {\n", k)
+			text, err := m.opts.Marshal(msg)
+			if nil != err {
+				return nil, fmt.Errorf("prototext marshal field %q: %w", k, err)
+			}
+			buf.Write(text)
+			buf.WriteString("}\n")
+			continue
+		}
+		fmt.Fprintf(&buf, "%s: %q\n", k, fmt.Sprintf("%v", v))
+	}
+	return buf.Bytes(), nil
+}
+
+// toGenericRow converts any proto.Message values in row to plain
+// map[string]interface{}/[]interface{}/... values (via protojson) so that
+// general-purpose encoders like CBOR and MessagePack, which don't know
+// about protoreflect, can encode the row directly.
+func toGenericRow(row map[string]interface{}) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(row))
+	for k, v := range row {
+		msg, ok := v.(proto.Message)
+		if !ok {
+			out[k] = v
+			continue
+		}
+		raw, err := protojson.Marshal(msg)
+		if nil != err {
+			return nil, fmt.Errorf("marshal field %q: %w", k, err)
+		}
+		var generic interface{}
+		if err := json.Unmarshal(raw, &generic); nil != err {
+			return nil, fmt.Errorf("decode field %q: %w", k, err)
+		}
+		out[k] = generic
+	}
+	return out, nil
+}
+
+// CBORMarshaler renders the row as a compact CBOR binary object, suitable
+// for downstream pipelines that don't want to pay a JSON parsing cost.
+type CBORMarshaler struct{}
+
+func (m *CBORMarshaler) Marshal(row map[string]interface{}) ([]byte, error) {
+	generic, err := toGenericRow(row)
+	if nil != err {
+		return nil, err
+	}
+	return cbor.Marshal(generic)
+}
+
+// MsgpackMarshaler renders the row as MessagePack.
+type MsgpackMarshaler struct{}
+
+func (m *MsgpackMarshaler) Marshal(row map[string]interface{}) ([]byte, error) {
+	generic, err := toGenericRow(row)
+	if nil != err {
+		return nil, err
+	}
+	return msgpack.Marshal(generic)
+}
+
+// AvroMarshaler renders the whole row (the decoded message plus any other
+// CSV columns) as a single Avro record, as a raw binary fragment -- the
+// right shape for the console/kafka/s3 writers and the file/rotating-file
+// writers, all of which take whatever bytes Marshal returns one record at a
+// time (every writer but kafka adds a '\n' byte after each record). It deliberately does not wrap output in an Avro Object
+// Container File: an OCF needs a single schema header and sync markers
+// shared across the whole file, and Marshal is called once per row with no
+// visibility into which Writer it's feeding or when the stream ends, so
+// there's nowhere in the current Marshaler/Writer split to hang that
+// framing. A -marshaler avro -writer file output is therefore raw Avro
+// binary records, each followed by the writer's '\n' byte, not a valid
+// standalone .avro file; consuming it
+// means replaying the same schema (the derived one, or -avro-schema)
+// against each record-sized chunk, the same way avro.Unmarshal is used in
+// this package's tests. The schema is either the user-supplied .avsc, or
+// derived from the row: the proto.Message field becomes a nested record
+// matching its descriptor, every other field becomes a nullable string.
+// Values are read directly off the message via protoreflect rather than
+// round-tripped through protojson/JSON, since that round trip renders
+// int64-family fields as strings and bytes fields as base64 strings,
+// neither of which matches the "long"/"bytes" schema types below.
+type AvroMarshaler struct {
+	mutex   sync.Mutex // guards derived: Marshal is called concurrently by every receiver goroutine
+	derived map[string]avro.Schema
+
+	explicitSchema avro.Schema
+}
+
+func NewAvroMarshaler(schemaFile string) (*AvroMarshaler, error) {
+	m := &AvroMarshaler{derived: make(map[string]avro.Schema)}
+	if 0 == len(schemaFile) {
+		return m, nil
+	}
+	raw, err := ioutil.ReadFile(schemaFile)
+	if nil != err {
+		return nil, err
+	}
+	schema, err := avro.Parse(string(raw))
+	if nil != err {
+		return nil, fmt.Errorf("parse avro schema %s: %w", schemaFile, err)
+	}
+	m.explicitSchema = schema
+	return m, nil
+}
+
+func (m *AvroMarshaler) Marshal(row map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(row))
+	for k := range row {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	schema, err := m.schemaFor(keys, row)
+	if nil != err {
+		return nil, err
+	}
+
+	values := make(map[string]interface{}, len(row))
+	for _, k := range keys {
+		v := row[k]
+		msg, ok := v.(proto.Message)
+		if !ok {
+			values[k] = fmt.Sprintf("%v", v)
+			continue
+		}
+		fieldSchema := avroFieldSchema(schema, k)
+		fields, err := messageToAvroMap(msg, fieldSchema)
+		if nil != err {
+			return nil, fmt.Errorf("avro encode field %q: %w", k, err)
+		}
+		values[k] = avroWrapIfUnion(fieldSchema, string(msg.ProtoReflect().Descriptor().FullName()), fields)
+	}
+
+	encoded, err := avro.Marshal(schema, values)
+	if nil != err {
+		return nil, fmt.Errorf("avro marshal: %w", err)
+	}
+	return encoded, nil
+}
+
+// schemaFor returns the schema for a row shaped like keys/row: every
+// non-message column as a nullable string, and the proto.Message column (if
+// any) as a nested record derived from its descriptor. Rows built from the
+// same -fields/-dataField flags always have the same keys and the same
+// message type, so caching on the sorted key list plus the message's full
+// name is sufficient for the lifetime of one process. Marshal is called
+// concurrently from every receiver goroutine, so the cache is guarded by
+// m.mutex rather than assumed single-threaded.
+func (m *AvroMarshaler) schemaFor(keys []string, row map[string]interface{}) (avro.Schema, error) {
+	if nil != m.explicitSchema {
+		return m.explicitSchema, nil
+	}
+
+	var msgName protoreflect.FullName
+	for _, k := range keys {
+		if msg, ok := row[k].(proto.Message); ok {
+			msgName = msg.ProtoReflect().Descriptor().FullName()
+			break
+		}
+	}
+	cacheKey := fmt.Sprintf("%s|%s", strings.Join(keys, ","), msgName)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if schema, ok := m.derived[cacheKey]; ok {
+		return schema, nil
+	}
+
+	avroFields := make([]string, 0, len(keys))
+	for _, k := range keys {
+		var fieldSchema string
+		if msg, ok := row[k].(proto.Message); ok {
+			nested, err := deriveAvroSchema(msg.ProtoReflect().Descriptor())
+			if nil != err {
+				return nil, err
+			}
+			// Nullable, like every other Row field below: a bare (non-union)
+			// record type here can't carry the "default":null every field
+			// gets, and avro.Parse rejects that mismatch outright.
+			fieldSchema = fmt.Sprintf(`["null",%s]`, nested.String())
+		} else {
+			fieldSchema = `["null","string"]`
+		}
+		avroFields = append(avroFields, fmt.Sprintf(`{"name":%q,"type":%s,"default":null}`, k, fieldSchema))
+	}
+	schemaJSON := fmt.Sprintf(`{"type":"record","name":"Row","fields":[%s]}`, joinComma(avroFields))
+	schema, err := avro.Parse(schemaJSON)
+	if nil != err {
+		return nil, err
+	}
+	m.derived[cacheKey] = schema
+	return schema, nil
+}
+
+// messageToAvroMap reads msg's fields directly via protoreflect into a
+// map[string]interface{} of native Go values matching the types
+// deriveAvroSchema declares (int32, int64, float32, float64, bool, string,
+// []byte, nested maps, slices), so the values avro.Marshal sees always
+// match the schema it was given. rec is the avro schema node msg's fields
+// are encoded against (the "Row" schema's field for a top-level message, or
+// a message field's own schema one level down); it may be nil if the schema
+// couldn't be resolved, in which case nested message fields fall back to
+// their proto full name as the union discriminator (see avroWrapIfUnion).
+func messageToAvroMap(msg proto.Message, rec avro.Schema) (map[string]interface{}, error) {
+	refl := msg.ProtoReflect()
+	fields := refl.Descriptor().Fields()
+	out := make(map[string]interface{}, fields.Len())
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		name := field.JSONName()
+		if !refl.Has(field) {
+			out[name] = nil
+			continue
+		}
+		v, err := avroValueFor(field, refl.Get(field), avroFieldSchema(rec, name))
+		if nil != err {
+			return nil, err
+		}
+		out[name] = v
+	}
+	return out, nil
+}
+
+func avroValueFor(field protoreflect.FieldDescriptor, v protoreflect.Value, schema avro.Schema) (interface{}, error) {
+	// IsMap is checked ahead of IsList: a proto map field is represented in
+	// protoreflect as a repeated synthetic MapEntry message (Kind() ==
+	// MessageKind, IsList() == false), not as a list, so it needs its own
+	// branch rather than falling through to avroElemFor's MessageKind case,
+	// which would call v.Message() on a value that actually holds a Map and
+	// panic.
+	if field.IsMap() {
+		entries, err := avroMapValueFor(field, v.Map(), schema)
+		if nil != err {
+			return nil, err
+		}
+		return avroWrapIfUnion(schema, "map", entries), nil
+	}
+	if field.IsList() {
+		var itemSchema avro.Schema
+		if arr, ok := unwrapAvroSchema(schema).(*avro.ArraySchema); ok {
+			itemSchema = arr.Items()
+		}
+		list := v.List()
+		out := make([]interface{}, list.Len())
+		for i := 0; i < list.Len(); i++ {
+			elem, err := avroElemFor(field, list.Get(i), itemSchema)
+			if nil != err {
+				return nil, err
+			}
+			out[i] = elem
+		}
+		return out, nil
+	}
+	return avroElemFor(field, v, schema)
+}
+
+// avroMapValueFor converts a proto map field's entries to the
+// map[string]interface{} hamba/avro's generic map encoder expects for an
+// Avro "map" schema. Avro map keys are always strings, so non-string proto
+// map keys (int32/int64/bool) are rendered via MapKey.String(). field.MapValue()
+// describes the synthetic per-entry "value" field, whose Kind()/Message()
+// avroElemFor uses exactly as it would for any other field. A
+// message-valued entry is wrapped in the union discriminator map only when
+// the map's values schema is a union; the derived schema (avroTypeFor)
+// never makes it one, so there the entries are passed bare.
+func avroMapValueFor(field protoreflect.FieldDescriptor, m protoreflect.Map, schema avro.Schema) (map[string]interface{}, error) {
+	var valueSchema avro.Schema
+	if ms, ok := unwrapAvroSchema(schema).(*avro.MapSchema); ok {
+		valueSchema = ms.Values()
+	}
+
+	out := make(map[string]interface{}, m.Len())
+	var rangeErr error
+	m.Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+		elem, err := avroElemFor(field.MapValue(), v, valueSchema)
+		if nil != err {
+			rangeErr = err
+			return false
+		}
+		out[k.String()] = elem
+		return true
+	})
+	if nil != rangeErr {
+		return nil, rangeErr
+	}
+	return out, nil
+}
+
+// avroElemFor returns v's avro-ready value for schema. A message value is
+// wrapped in the {"<record name>": fields} discriminator map that
+// hamba/avro's generic map encoder requires at a union position: any bare
+// map[string]interface{} handed to a union is read as that discriminator
+// format rather than as a record's own fields (see mapUnionEncoder.Encode in
+// hamba/avro/v2's codec_union.go), so a record can only be passed bare where
+// the schema resolves straight to a record -- true for array elements,
+// which deriveAvroSchemaJSON never wraps in a union, but not for a named
+// field, which schemaFor/deriveAvroSchemaJSON always wrap in ["null", ...].
+// Every other proto kind is returned as a plain Go scalar: the generic
+// union encoder resolves those branches from the value's own Go type, no
+// wrapping needed.
+func avroElemFor(field protoreflect.FieldDescriptor, v protoreflect.Value, schema avro.Schema) (interface{}, error) {
+	if field.Kind() != protoreflect.MessageKind && field.Kind() != protoreflect.GroupKind {
+		return avroScalarFor(field, v)
+	}
+
+	fields, err := messageToAvroMap(v.Message().Interface(), schema)
+	if nil != err {
+		return nil, err
+	}
+	return avroWrapIfUnion(schema, string(field.Message().FullName()), fields), nil
+}
+
+func avroScalarFor(field protoreflect.FieldDescriptor, v protoreflect.Value) (interface{}, error) {
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		return v.Bool(), nil
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return int32(v.Int()), nil
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		// uint32 doesn't fit Avro's signed "int"; avroTypeFor declares
+		// these as "long" so the wider, still-signed long always fits.
+		return int64(v.Uint()), nil
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return v.Int(), nil
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		// Avro has no unsigned 64-bit type; a value above math.MaxInt64
+		// would silently wrap to negative in a "long", so reject it
+		// instead of producing a corrupt record.
+		if v.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("field %s: value %d overflows avro's signed long", field.FullName(), v.Uint())
+		}
+		return int64(v.Uint()), nil
+	case protoreflect.FloatKind:
+		return float32(v.Float()), nil
+	case protoreflect.DoubleKind:
+		return v.Float(), nil
+	case protoreflect.StringKind:
+		return v.String(), nil
+	case protoreflect.BytesKind:
+		return v.Bytes(), nil
+	case protoreflect.EnumKind:
+		enumValue := field.Enum().Values().ByNumber(v.Enum())
+		if nil == enumValue {
+			return fmt.Sprintf("%d", v.Enum()), nil
+		}
+		return string(enumValue.Name()), nil
+	default:
+		return nil, fmt.Errorf("unsupported proto kind %v for avro encoding", field.Kind())
+	}
+}
+
+// unwrapAvroSchema follows ref and nullable-union wrappers down to the
+// concrete schema node beneath them (a record, array or primitive), so
+// callers can inspect the actual shape of a field's type without caring
+// whether it arrived wrapped in ["null", ...] or as a named reference to an
+// already-emitted record.
+func unwrapAvroSchema(schema avro.Schema) avro.Schema {
+	switch t := schema.(type) {
+	case nil:
+		return nil
+	case *avro.RefSchema:
+		return unwrapAvroSchema(t.Schema())
+	case *avro.UnionSchema:
+		for _, sub := range t.Types() {
+			if avro.Null == sub.Type() {
+				continue
+			}
+			return unwrapAvroSchema(sub)
+		}
+	}
+	return schema
+}
+
+// avroFieldSchema returns the schema of rec's field named name, or nil if
+// rec doesn't resolve to a record or has no such field -- e.g. a
+// user-supplied -avro-schema that doesn't mirror the message's shape.
+func avroFieldSchema(rec avro.Schema, name string) avro.Schema {
+	r, ok := unwrapAvroSchema(rec).(*avro.RecordSchema)
+	if !ok {
+		return nil
+	}
+	for _, f := range r.Fields() {
+		if f.Name() == name {
+			return f.Type()
+		}
+	}
+	return nil
+}
+
+// avroWrapIfUnion wraps value in the {"<branch name>": value} discriminator
+// map hamba/avro's generic encoder expects when schema is a union, using the
+// name of schema's own branch where it resolves to a record (its FullName)
+// or a map (the literal "map", Avro's type-name fallback for unnamed
+// schemas) and falling back to fallbackName otherwise. value is returned
+// bare when schema isn't a union, matching an array element position.
+func avroWrapIfUnion(schema avro.Schema, fallbackName string, value map[string]interface{}) interface{} {
+	if _, ok := schema.(*avro.UnionSchema); !ok {
+		return value
+	}
+	name := fallbackName
+	switch resolved := unwrapAvroSchema(schema).(type) {
+	case *avro.RecordSchema:
+		name = resolved.FullName()
+	case *avro.MapSchema:
+		name = "map"
+	}
+	return map[string]interface{}{name: value}
+}
+
+// deriveAvroSchema builds an Avro record schema from a proto message
+// descriptor, mapping proto scalar kinds to Avro primitives, repeated
+// fields to arrays, and message fields to nested records.
+func deriveAvroSchema(md protoreflect.MessageDescriptor) (avro.Schema, error) {
+	schemaJSON, err := deriveAvroSchemaJSON(md, make(map[protoreflect.FullName]struct{}))
+	if nil != err {
+		return nil, err
+	}
+	return avro.Parse(schemaJSON)
+}
+
+// deriveAvroSchemaJSON is the recursive worker behind deriveAvroSchema. emitted
+// tracks every message full name already given a full record definition in
+// this schema: a message referenced more than once (two fields of the same
+// type, a repeated field, or a recursive type) gets its record emitted only
+// the first time it's encountered and is referenced by name thereafter, since
+// Avro rejects a schema that redefines the same named type twice. The name is
+// reserved before recursing into the message's own fields so a
+// self-referencing type (e.g. a tree node) resolves to a name reference
+// instead of recursing forever. The full proto name is used as the Avro
+// record name, rather than just the message's short name, so that two
+// distinct messages that happen to share a short name don't collide.
+func deriveAvroSchemaJSON(md protoreflect.MessageDescriptor, emitted map[protoreflect.FullName]struct{}) (string, error) {
+	fullName := md.FullName()
+	if _, ok := emitted[fullName]; ok {
+		return fmt.Sprintf("%q", string(fullName)), nil
+	}
+	emitted[fullName] = struct{}{}
+
+	fields := md.Fields()
+	avroFields := make([]string, 0, fields.Len())
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		fieldSchema, err := avroTypeFor(field, emitted)
+		if nil != err {
+			return "", err
+		}
+		avroFields = append(avroFields, fmt.Sprintf(`{"name":%q,"type":["null",%s],"default":null}`, field.JSONName(), fieldSchema))
+	}
+	return fmt.Sprintf(`{"type":"record","name":%q,"fields":[%s]}`, string(fullName), joinComma(avroFields)), nil
+}
+
+func joinComma(parts []string) string {
+	var buf bytes.Buffer
+	for i, p := range parts {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(p)
+	}
+	return buf.String()
+}
+
+func avroTypeFor(field protoreflect.FieldDescriptor, emitted map[protoreflect.FullName]struct{}) (string, error) {
+	// A proto map field reports Kind() == MessageKind for its synthetic
+	// MapEntry type, so it has to be peeled off before the switch below --
+	// otherwise it would be schema'd as a nested {key,value} record instead
+	// of an Avro map. IsList() is never true for a map field (the two are
+	// mutually exclusive), so this doesn't need to interact with the
+	// field.IsList() check further down.
+	if field.IsMap() {
+		valueSchema, err := avroTypeFor(field.MapValue(), emitted)
+		if nil != err {
+			return "", err
+		}
+		return fmt.Sprintf(`{"type":"map","values":%s}`, valueSchema), nil
+	}
+
+	var base string
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		base = `"boolean"`
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		base = `"int"`
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		// a uint32 above math.MaxInt32 would wrap in a signed "int";
+		// "long" always fits.
+		base = `"long"`
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		base = `"long"`
+	case protoreflect.FloatKind:
+		base = `"float"`
+	case protoreflect.DoubleKind:
+		base = `"double"`
+	case protoreflect.StringKind:
+		base = `"string"`
+	case protoreflect.BytesKind:
+		base = `"bytes"`
+	case protoreflect.EnumKind:
+		base = `"string"`
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		nested, err := deriveAvroSchemaJSON(field.Message(), emitted)
+		if nil != err {
+			return "", err
+		}
+		base = nested
+	default:
+		return "", fmt.Errorf("unsupported proto kind %v for avro schema derivation", field.Kind())
+	}
+	if field.IsList() {
+		return fmt.Sprintf(`{"type":"array","items":%s}`, base), nil
+	}
+	return base, nil
+}
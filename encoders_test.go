@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hamba/avro/v2"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// TestAvroMarshalerRoundTrip exercises the derived-schema happy path with a
+// message that has more than one populated field and a nested message
+// field, the exact shape the four earlier avro fix commits never ran
+// against: every one of them would have failed this test.
+func TestAvroMarshalerRoundTrip(t *testing.T) {
+	msg := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("demo.proto"),
+		Package: proto.String("demo.pkg"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Outer"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{Name: proto.String("id"), Number: proto.Int32(1), Type: descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum()},
+				},
+			},
+		},
+	}
+
+	m, err := NewAvroMarshaler("")
+	if nil != err {
+		t.Fatalf("NewAvroMarshaler: %v", err)
+	}
+
+	row := map[string]interface{}{"data": msg, "offset": "17"}
+	encoded, err := m.Marshal(row)
+	if nil != err {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	schema, err := m.schemaFor([]string{"data", "offset"}, row)
+	if nil != err {
+		t.Fatalf("schemaFor: %v", err)
+	}
+	var decoded map[string]interface{}
+	if err := avro.Unmarshal(schema, encoded, &decoded); nil != err {
+		t.Fatalf("round-trip decode: %v", err)
+	}
+	if decoded["offset"] != "17" {
+		t.Fatalf("offset = %v, want 17", decoded["offset"])
+	}
+}
+
+// TestAvroMarshalerMapField exercises a message with a proto map field
+// (map<string,string>), built by hand via protodesc/dynamicpb the way
+// protoc itself lowers map syntax to a repeated synthetic MapEntry message
+// -- descriptorpb's own messages never exercise this shape. Kind() reports
+// MessageKind for that synthetic entry type, so this is the case that used
+// to panic in v.Message() before avroValueFor grew an IsMap() branch.
+func TestAvroMarshalerMapField(t *testing.T) {
+	fdProto := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("tagged.proto"),
+		Package: proto.String("demo.pkg"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Tagged"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{Name: proto.String("id"), Number: proto.Int32(1), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(), Type: descriptorpb.FieldDescriptorProto_TYPE_INT32.Enum()},
+					{Name: proto.String("tags"), Number: proto.Int32(2), Label: descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum(), Type: descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(), TypeName: proto.String(".demo.pkg.Tagged.TagsEntry")},
+				},
+				NestedType: []*descriptorpb.DescriptorProto{
+					{
+						Name: proto.String("TagsEntry"),
+						Field: []*descriptorpb.FieldDescriptorProto{
+							{Name: proto.String("key"), Number: proto.Int32(1), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()},
+							{Name: proto.String("value"), Number: proto.Int32(2), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()},
+						},
+						Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+					},
+				},
+			},
+		},
+	}
+	fd, err := protodesc.NewFile(fdProto, nil)
+	if nil != err {
+		t.Fatalf("NewFile: %v", err)
+	}
+	md := fd.Messages().ByName("Tagged")
+	msg := dynamicpb.NewMessage(md)
+
+	fields := md.Fields()
+	msg.Set(fields.ByName("id"), protoreflect.ValueOfInt32(7))
+	tags := msg.Mutable(fields.ByName("tags")).Map()
+	tags.Set(protoreflect.ValueOfString("a").MapKey(), protoreflect.ValueOfString("1"))
+	tags.Set(protoreflect.ValueOfString("b").MapKey(), protoreflect.ValueOfString("2"))
+
+	m, err := NewAvroMarshaler("")
+	if nil != err {
+		t.Fatalf("NewAvroMarshaler: %v", err)
+	}
+
+	row := map[string]interface{}{"data": msg}
+	encoded, err := m.Marshal(row)
+	if nil != err {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	schema, err := m.schemaFor([]string{"data"}, row)
+	if nil != err {
+		t.Fatalf("schemaFor: %v", err)
+	}
+	var decoded map[string]interface{}
+	if err := avro.Unmarshal(schema, encoded, &decoded); nil != err {
+		t.Fatalf("round-trip decode: %v", err)
+	}
+
+	tagged, ok := decoded["data"].(map[string]interface{})["demo.pkg.Tagged"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("decoded = %#v, want a demo.pkg.Tagged record", decoded["data"])
+	}
+	tagsOut, ok := tagged["tags"].(map[string]interface{})["map"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("tags = %#v, want a map value", tagged["tags"])
+	}
+	if tagsOut["a"] != "1" || tagsOut["b"] != "2" {
+		t.Fatalf("tags = %v, want {a:1 b:2}", tagsOut)
+	}
+}
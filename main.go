@@ -1,66 +1,42 @@
 package main
 
 import (
+	"context"
 	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"google.golang.org/protobuf/proto"
-	"google.golang.org/protobuf/reflect/protodesc"
 	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/reflect/protoregistry"
-	"google.golang.org/protobuf/types/descriptorpb"
 	"google.golang.org/protobuf/types/dynamicpb"
 	"io"
-	"io/ioutil"
+	"log"
 	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
-func registerPbFile(filename string) error {
-	data, err := ioutil.ReadFile(filename)
-	if nil != err {
-		return err
-	}
-	set := new(descriptorpb.FileDescriptorSet)
-	if err := proto.Unmarshal(data, set); nil != err {
-		return err
-	}
-	pb := set.GetFile()[0]
-	fd, err := protodesc.NewFile(pb, protoregistry.GlobalFiles)
-	if nil != err {
-		return err
-	}
-
-	return protoregistry.GlobalFiles.RegisterFile(fd)
-}
-
-func convertToMap(descriptor protoreflect.MessageDescriptor, msg *dynamicpb.Message) map[string]interface{} {
-	result := make(map[string]interface{})
-	for i := 0; i < descriptor.Fields().Len(); i++ {
-		field := descriptor.Fields().Get(i)
-		if !msg.Has(field) {
-			continue
-		}
-		var value interface{}
-		if field.IsList() {
-			list := []interface{}{}
-			v := msg.Get(field).List()
-			for j := 0; j < v.Len(); j++ {
-				list = append(list, v.Get(j).Interface())
-			}
-			value = list
-		} else {
-			value = msg.Get(field).Interface()
+// DecodeFunc turns one row's raw payload into every message it produced --
+// one for the CSV/hex/base64/delimited paths, possibly many for a
+// server-streaming gRPC call.
+type DecodeFunc func(data []byte, msgName string) ([]proto.Message, error)
+
+// singleMessageDecode adapts a decode function that always produces exactly
+// one message (everything but gRPC server-streaming) to DecodeFunc.
+func singleMessageDecode(fn func(data []byte, msgName string) (proto.Message, error)) DecodeFunc {
+	return func(data []byte, msgName string) ([]proto.Message, error) {
+		msg, err := fn(data, msgName)
+		if nil != err {
+			return nil, err
 		}
-		result[string(field.Name())] = value
+		return []proto.Message{msg}, nil
 	}
-	return result
 }
 
-func unmarshalProtoData(data []byte, msgName string) (map[string]interface{}, error) {
+func unmarshalProtoData(data []byte, msgName string) (proto.Message, error) {
 	var descriptor protoreflect.MessageDescriptor
 	if desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(msgName)); nil != err {
 		return nil, err
@@ -71,10 +47,10 @@ func unmarshalProtoData(data []byte, msgName string) (map[string]interface{}, er
 	if err := proto.Unmarshal(data, msg); nil != err {
 		return nil, err
 	}
-	return convertToMap(descriptor, msg), nil
+	return msg, nil
 }
 
-func parseData(data []byte, msgName string) (map[string]interface{}, error) {
+func parseData(data []byte, msgName string) (proto.Message, error) {
 	var binary []byte
 	var pos int
 	var err error
@@ -96,17 +72,6 @@ type Data struct {
 	data map[string]interface{}
 }
 
-type Marshaler interface {
-	Marshal(map[string]interface{}) ([]byte, error)
-}
-
-type JsonMarshaler struct {
-}
-
-func (m *JsonMarshaler) Marshal(value map[string]interface{}) ([]byte, error) {
-	return json.Marshal(value)
-}
-
 type Writer interface {
 	Write([]byte) error
 }
@@ -125,6 +90,10 @@ func (w *FileWriter) OpenFile(filename string) error {
 	return nil
 }
 
+func (w *FileWriter) Close() error {
+	return w.file.Close()
+}
+
 func (w *FileWriter) Write(data []byte) error {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
@@ -184,7 +153,24 @@ func main() {
 	var marshalerName string
 	var fieldsParam string
 	var dataField string
-	pbFile := flag.String("pb", "a", "specified the protobuf descriptor files")
+	var jsonEmitDefaults bool
+	var jsonUseProtoNames bool
+	var jsonIndent string
+	var modeName string
+	var grpcAddr string
+	var grpcMethod string
+	var grpcTLS bool
+	var grpcTimeout time.Duration
+	var metricsAddr string
+	var partitionKeyField string
+	var rotateMaxBytes int64
+	var rotateInterval time.Duration
+	var batchMaxBytes int
+	var batchInterval time.Duration
+	var avroSchema string
+	var inputFormat string
+	var pbFiles pbFileList
+	flag.Var(&pbFiles, "pb", "specified the protobuf descriptor file, repeatable; a directory registers every *.pb/*.desc/*.binpb file under it")
 	msgName := flag.String("name", "b", "specified the message name")
 	//isHex := flag.Bool("hex", false, "the input data is hex format")
 	flag.StringVar(&data, "data", "", "the input data")
@@ -192,12 +178,39 @@ func main() {
 	flag.StringVar(&dstFile, "dstfile", "", "specify the output file")
 	flag.IntVar(&receiverNum, "recv", 10, "specify the parse thread count")
 
-	flag.StringVar(&writerName, "writer", "console", "specify writer name, valid options: console, file")
-	flag.StringVar(&marshalerName, "marshaler", "json", "specify marshaler name, valid options: json")
+	flag.StringVar(&writerName, "writer", "console", "specify writer name, valid options: console, file, rotating-file, kafka, s3")
+	flag.StringVar(&partitionKeyField, "writer-key-field", "", "CSV field to use as the partition/shard key for writers that support it (kafka)")
+	flag.Int64Var(&rotateMaxBytes, "writer-rotate-bytes", 0, "rotate the rotating-file writer once it has written this many bytes (0 disables size-based rotation)")
+	flag.DurationVar(&rotateInterval, "writer-rotate-interval", 0, "rotate the rotating-file writer after this much time has passed (0 disables time-based rotation)")
+	flag.IntVar(&batchMaxBytes, "writer-batch-bytes", 4<<20, "flush the s3 writer once its buffered batch reaches this many bytes")
+	flag.DurationVar(&batchInterval, "writer-batch-interval", 30*time.Second, "flush the s3 writer's buffered batch at this fixed interval, counted from writer creation")
+	flag.StringVar(&marshalerName, "marshaler", "json", "specify marshaler name, valid options: json, prototext, cbor, msgpack, avro")
+	flag.StringVar(&avroSchema, "avro-schema", "", "path to a .avsc file for the avro marshaler; when empty the schema is derived from the message descriptor")
 	flag.StringVar(&fieldsParam, "fields", "data", "specify the all fields name")
 	flag.StringVar(&dataField, "dataField", "data", "specify the all fields name")
+	flag.BoolVar(&jsonEmitDefaults, "json-emit-defaults", false, "emit fields with default/zero values in the json marshaler")
+	flag.BoolVar(&jsonUseProtoNames, "json-use-proto-names", false, "use the original proto field names instead of camelCase in the json marshaler")
+	flag.StringVar(&jsonIndent, "json-indent", "", "indent string used to pretty-print the json marshaler output, e.g. \"  \"")
+	flag.StringVar(&modeName, "mode", "csv", "specify input mode, valid options: csv, grpc")
+	flag.StringVar(&inputFormat, "input-format", "csv", "specify the input row format, valid options: csv, ndjson-hex, base64, delimited; with -mode grpc, csv builds each request from the CSV columns and any other value reads one JSON request per line")
+	flag.StringVar(&grpcAddr, "grpc-addr", "", "the gRPC server address to dial when -mode grpc is used")
+	flag.StringVar(&grpcMethod, "method", "", "the fully-qualified method to invoke when -mode grpc is used, e.g. pkg.Service/Method")
+	flag.BoolVar(&grpcTLS, "grpc-tls", false, "use TLS when dialing -grpc-addr")
+	flag.DurationVar(&grpcTimeout, "grpc-timeout", 30*time.Second, "deadline for each -mode grpc call, including draining a server-streaming response; 0 disables the deadline")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "if set, serve Prometheus metrics on this address, e.g. :9090")
 	flag.Parse()
 
+	ctx := context.Background()
+	shutdownTracer, err := initTracer(ctx)
+	if nil != err {
+		panic(err)
+	}
+	defer shutdownTracer(ctx)
+
+	if 0 != len(metricsAddr) {
+		startMetricsServer(metricsAddr)
+	}
+
 	fields := strings.Split(fieldsParam, ",")
 
 	hasDataField := false
@@ -214,7 +227,7 @@ func main() {
 		panic(fmt.Errorf("the data field '%s' isn't in fields list", dataField))
 	}
 
-	if err := registerPbFile(*pbFile); nil != err {
+	if err := registerPbFiles(pbFiles); nil != err {
 		panic(err)
 	}
 
@@ -222,27 +235,68 @@ func main() {
 		panic(fmt.Errorf("the receiver count is less and equal than zero"))
 	}
 	dataList := make(chan *Data, receiverNum*2)
+	go watchQueueDepth(dataList)
 	wg := sync.WaitGroup{}
 
-	var writer Writer = nil
-	var marshaler Marshaler = nil
+	marshaler, err := NewMarshaler(marshalerName, MarshalerConfig{
+		EmitDefaults:  jsonEmitDefaults,
+		UseProtoNames: jsonUseProtoNames,
+		Indent:        jsonIndent,
+		AvroSchema:    avroSchema,
+	})
+	if nil != err {
+		panic(err)
+	}
 
-	if "console" == writerName {
-		writer = &ConsoleWriter{}
-	} else if "file" == writerName {
-		fileWriter := &FileWriter{}
-		if err := fileWriter.OpenFile(dstFile); nil != err {
+	writer, err := NewWriter(writerName, WriterConfig{
+		Dest:              dstFile,
+		PartitionKeyField: partitionKeyField,
+		RotateMaxBytes:    rotateMaxBytes,
+		RotateInterval:    rotateInterval,
+		BatchMaxBytes:     batchMaxBytes,
+		BatchInterval:     batchInterval,
+	})
+	if nil != err {
+		panic(err)
+	}
+	keyedWriter, writerHasKey := writer.(KeyedWriter)
+
+	var decode DecodeFunc
+	var reader InputReader
+	// grpcRowFromCSV is set when -mode grpc is reading -input-format csv
+	// rows: the request message is populated from the row's CSV columns
+	// (one proto field per column, by name) rather than from a JSON body,
+	// so the worker loop below has to build the payload handed to
+	// GRPCInvoker.InvokeAll differently for this combination.
+	grpcRowFromCSV := false
+	if "csv" == modeName {
+		decode, err = getDecodeFunc(inputFormat)
+		if nil != err {
 			panic(err)
 		}
-		writer = fileWriter
-	} else {
-		panic(fmt.Errorf("invalid writer name:%v", writerName))
-	}
-
-	if "json" == marshalerName {
-		marshaler = &JsonMarshaler{}
+		reader, err = getInputReader(inputFormat)
+		if nil != err {
+			panic(err)
+		}
+	} else if "grpc" == modeName {
+		invoker, err := NewGRPCInvoker(grpcAddr, grpcMethod, grpcTLS, grpcTimeout)
+		if nil != err {
+			panic(err)
+		}
+		defer invoker.Close()
+		decode = invoker.InvokeAll
+		if "csv" == inputFormat {
+			grpcRowFromCSV = true
+			reader = csvInputReader{}
+		} else {
+			// Each row is a whole protojson request body, not a CSV field:
+			// reading it through csvInputReader would run it through Go's CSV
+			// quoting rules, and a request containing an unescaped '"' (i.e.
+			// almost any JSON object) would fail to parse as a CSV record.
+			reader = lineInputReader{}
+		}
 	} else {
-		panic(fmt.Errorf("invalid marshaler name:%v", marshalerName))
+		panic(fmt.Errorf("invalid mode:%v", modeName))
 	}
 
 	if 0 != len(srcFile) {
@@ -253,14 +307,14 @@ func main() {
 			}
 			defer f.Close()
 
-			if err := ReadData(dataList, f, fields); nil != err {
+			if err := reader.Read(dataList, f, fields, dataField); nil != err {
 				panic(err)
 			}
 			close(dataList)
 		}()
 	} else {
 		r := strings.NewReader(data)
-		if err := ReadData(dataList, r, fields); nil != err {
+		if err := reader.Read(dataList, r, fields, dataField); nil != err {
 			panic(err)
 		}
 		close(dataList)
@@ -272,21 +326,63 @@ func main() {
 			defer wg.Done()
 
 			for data := range dataList {
-				msg, err := parseData([]byte(data.data[dataField].(string)), *msgName)
-				if nil != err {
-					panic(err)
+				var payload []byte
+				if grpcRowFromCSV {
+					// Every CSV column becomes a request field of the same
+					// name; protojson.Unmarshal in GRPCInvoker.InvokeAll
+					// does the actual type coercion (it accepts a quoted
+					// string for numeric fields, but not for bool -- a
+					// "true"/"false" column must be renamed out of -fields
+					// if the target field is a bool).
+					encoded, encErr := json.Marshal(data.data)
+					if nil != encErr {
+						panic(fmt.Errorf("encode csv row as grpc request json on line %d: %w", data.line, encErr))
+					}
+					payload = encoded
+				} else {
+					switch v := data.data[dataField].(type) {
+					case []byte:
+						payload = v
+					case string:
+						payload = []byte(v)
+					default:
+						panic(fmt.Errorf("unsupported data field type %T on line %d", v, data.line))
+					}
 				}
-				data.data[dataField] = msg
-				text, err := marshaler.Marshal(data.data)
+				msgs, err := recordDecode(ctx, data.line, *msgName, payload, decode)
 				if nil != err {
-					panic(err)
+					log.Printf("line %d: decode: %v", data.line, err)
+					continue
 				}
-				if err := writer.Write(text); nil != err {
-					panic(err)
+				for _, msg := range msgs {
+					data.data[dataField] = msg
+					text, err := recordMarshal(ctx, data.line, *msgName, func() ([]byte, error) {
+						return marshaler.Marshal(data.data)
+					})
+					if nil != err {
+						log.Printf("line %d: marshal: %v", data.line, err)
+						continue
+					}
+					writeErr := recordWrite(ctx, data.line, func() error {
+						if writerHasKey && 0 != len(partitionKeyField) {
+							key := fmt.Sprintf("%v", data.data[partitionKeyField])
+							return keyedWriter.WriteKeyed(key, text)
+						}
+						return writer.Write(text)
+					})
+					if nil != writeErr {
+						log.Printf("line %d: write: %v", data.line, writeErr)
+					}
 				}
 			}
 		}(i)
 	}
 
 	wg.Wait()
+
+	if closer, ok := writer.(io.Closer); ok {
+		if err := closer.Close(); nil != err {
+			log.Printf("writer close: %v", err)
+		}
+	}
 }
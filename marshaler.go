@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Marshaler turns a decoded CSV row into its final serialized form. The
+// dataField entry of the row holds the decoded proto.Message produced by
+// the selected decode function (see decodeFuncs, or GRPCInvoker.InvokeAll
+// for -mode grpc); the remaining entries are the untouched CSV columns.
+type Marshaler interface {
+	Marshal(map[string]interface{}) ([]byte, error)
+}
+
+// ProtoJsonMarshaler renders the decoded message using the canonical
+// proto3 JSON mapping (protojson) instead of reflecting over the message
+// by hand, so enums, bytes, maps, oneofs, well-known types and nested
+// messages all come out the way protoc-gen-go's own JSON support would
+// render them. Any other CSV columns are marshaled alongside it as plain
+// JSON values.
+type ProtoJsonMarshaler struct {
+	opts   protojson.MarshalOptions
+	indent string
+}
+
+// NewProtoJsonMarshaler builds a ProtoJsonMarshaler from the -json-* flags.
+func NewProtoJsonMarshaler(emitDefaults, useProtoNames bool, indent string) *ProtoJsonMarshaler {
+	return &ProtoJsonMarshaler{
+		opts: protojson.MarshalOptions{
+			EmitUnpopulated: emitDefaults,
+			UseProtoNames:   useProtoNames,
+			Indent:          indent,
+		},
+		indent: indent,
+	}
+}
+
+func (m *ProtoJsonMarshaler) Marshal(row map[string]interface{}) ([]byte, error) {
+	fields := make(map[string]json.RawMessage, len(row))
+	for k, v := range row {
+		switch msg := v.(type) {
+		case proto.Message:
+			raw, err := m.opts.Marshal(msg)
+			if nil != err {
+				return nil, fmt.Errorf("protojson marshal field %q: %w", k, err)
+			}
+			fields[k] = raw
+		default:
+			raw, err := json.Marshal(v)
+			if nil != err {
+				return nil, fmt.Errorf("json marshal field %q: %w", k, err)
+			}
+			fields[k] = raw
+		}
+	}
+	if 0 == len(m.indent) {
+		return json.Marshal(fields)
+	}
+	return json.MarshalIndent(fields, "", m.indent)
+}
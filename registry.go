@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// pbFileList collects the -pb flag, which is repeatable and also accepts a
+// directory (every *.pb / *.desc / *.binpb file under it is registered).
+type pbFileList []string
+
+func (l *pbFileList) String() string {
+	return fmt.Sprintf("%v", []string(*l))
+}
+
+func (l *pbFileList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// expandPbFiles resolves the -pb arguments into a flat list of descriptor
+// set files, expanding directories into every *.pb/*.desc/*.binpb file
+// found underneath them.
+func expandPbFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if nil != err {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		err = filepath.Walk(arg, func(path string, fi os.FileInfo, err error) error {
+			if nil != err {
+				return err
+			}
+			if fi.IsDir() {
+				return nil
+			}
+			switch filepath.Ext(path) {
+			case ".pb", ".desc", ".binpb":
+				files = append(files, path)
+			}
+			return nil
+		})
+		if nil != err {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// registerPbFiles loads every FileDescriptorSet named by args (plain files
+// or directories of them), topologically sorts the combined set of
+// FileDescriptorProto entries by their Dependency lists so that imports are
+// registered before the files that depend on them, and registers both the
+// files and their message/enum types so that protojson Any-unpacking and
+// nested message decoding resolve correctly.
+func registerPbFiles(args []string) error {
+	files, err := expandPbFiles(args)
+	if nil != err {
+		return err
+	}
+	if 0 == len(files) {
+		return fmt.Errorf("no protobuf descriptor files found in %v", args)
+	}
+
+	protos := make(map[string]*descriptorpb.FileDescriptorProto)
+	for _, filename := range files {
+		data, err := ioutil.ReadFile(filename)
+		if nil != err {
+			return err
+		}
+		set := new(descriptorpb.FileDescriptorSet)
+		if err := proto.Unmarshal(data, set); nil != err {
+			return err
+		}
+		for _, fdProto := range set.GetFile() {
+			protos[fdProto.GetName()] = fdProto
+		}
+	}
+
+	ordered, err := topoSortFileProtos(protos)
+	if nil != err {
+		return err
+	}
+
+	for _, fdProto := range ordered {
+		// protoc --include_imports bundles google/protobuf/*.proto and
+		// anything else the message depends on; those are frequently
+		// already known to the global registry (protojson links the WKT
+		// packages in), so registering them again would fail.
+		if existing, err := protoregistry.GlobalFiles.FindFileByPath(fdProto.GetName()); nil == err {
+			if err := registerTypes(existing); nil != err {
+				return err
+			}
+			continue
+		}
+
+		fd, err := protodesc.NewFile(fdProto, protoregistry.GlobalFiles)
+		if nil != err {
+			return fmt.Errorf("register %s: %w", fdProto.GetName(), err)
+		}
+		if err := protoregistry.GlobalFiles.RegisterFile(fd); nil != err {
+			return err
+		}
+		if err := registerTypes(fd); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// topoSortFileProtos orders file descriptors so that every dependency comes
+// before the file that imports it, as protodesc.NewFile requires.
+func topoSortFileProtos(protos map[string]*descriptorpb.FileDescriptorProto) ([]*descriptorpb.FileDescriptorProto, error) {
+	var ordered []*descriptorpb.FileDescriptorProto
+	visited := make(map[string]bool)
+	visiting := make(map[string]bool)
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		if visited[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("circular dependency detected involving %s", name)
+		}
+		fdProto, ok := protos[name]
+		if !ok {
+			// Dependency not present in the supplied sets; assume it is
+			// already known to the global registry (e.g. well-known types).
+			if _, err := protoregistry.GlobalFiles.FindFileByPath(name); nil == err {
+				visited[name] = true
+				return nil
+			}
+			return fmt.Errorf("missing dependency %s", name)
+		}
+		visiting[name] = true
+		for _, dep := range fdProto.GetDependency() {
+			if err := visit(dep); nil != err {
+				return err
+			}
+		}
+		visiting[name] = false
+		visited[name] = true
+		ordered = append(ordered, fdProto)
+		return nil
+	}
+
+	for name := range protos {
+		if err := visit(name); nil != err {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// registerTypes registers every message and enum declared directly in fd
+// into protoregistry.GlobalTypes, which protojson needs to resolve
+// google.protobuf.Any values and dynamicpb needs for nested messages.
+func registerTypes(fd protoreflect.FileDescriptor) error {
+	msgs := fd.Messages()
+	for i := 0; i < msgs.Len(); i++ {
+		if err := registerMessageType(msgs.Get(i)); nil != err {
+			return err
+		}
+	}
+	enums := fd.Enums()
+	for i := 0; i < enums.Len(); i++ {
+		if err := registerEnumType(enums.Get(i)); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+func registerMessageType(md protoreflect.MessageDescriptor) error {
+	if _, err := protoregistry.GlobalTypes.FindMessageByName(md.FullName()); nil != err {
+		if err := protoregistry.GlobalTypes.RegisterMessage(dynamicpb.NewMessageType(md)); nil != err {
+			return err
+		}
+	}
+	nested := md.Messages()
+	for i := 0; i < nested.Len(); i++ {
+		if err := registerMessageType(nested.Get(i)); nil != err {
+			return err
+		}
+	}
+	nestedEnums := md.Enums()
+	for i := 0; i < nestedEnums.Len(); i++ {
+		if err := registerEnumType(nestedEnums.Get(i)); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+func registerEnumType(ed protoreflect.EnumDescriptor) error {
+	if _, err := protoregistry.GlobalTypes.FindEnumByName(ed.FullName()); nil == err {
+		return nil
+	}
+	return protoregistry.GlobalTypes.RegisterEnum(dynamicpb.NewEnumType(ed))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+)
+
+const tracerName = "proto2json"
+
+var tracer trace.Tracer = otel.Tracer(tracerName)
+
+// initTracer wires up an OTLP/gRPC exporter when OTEL_EXPORTER_OTLP_ENDPOINT
+// is set, and otherwise leaves the global no-op tracer provider in place so
+// every span below costs nothing. The returned shutdown func flushes the
+// exporter and must be called before the process exits.
+func initTracer(ctx context.Context) (func(context.Context) error, error) {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if 0 == len(endpoint) {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpointURL(endpoint))
+	if nil != err {
+		return nil, fmt.Errorf("create otlp exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceNameKey.String(tracerName),
+	))
+	if nil != err {
+		return nil, fmt.Errorf("build otel resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	tracer = tp.Tracer(tracerName)
+
+	return tp.Shutdown, nil
+}
+
+var (
+	linesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "proto2json_lines_total",
+		Help: "Number of input lines read from the source.",
+	})
+	decodeErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "proto2json_decode_errors_total",
+		Help: "Number of lines that failed to decode into a protobuf message.",
+	})
+	marshalErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "proto2json_marshal_errors_total",
+		Help: "Number of decoded messages that failed to marshal.",
+	})
+	writeErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "proto2json_write_errors_total",
+		Help: "Number of marshaled records that failed to write.",
+	})
+	bytesDecodedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "proto2json_bytes_decoded_total",
+		Help: "Total bytes of binary protobuf payload successfully decoded.",
+	})
+	decodeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "proto2json_decode_duration_seconds",
+		Help:    "Latency of decoding a single message.",
+		Buckets: prometheus.DefBuckets,
+	})
+	marshalDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "proto2json_marshal_duration_seconds",
+		Help:    "Latency of marshaling a single decoded message.",
+		Buckets: prometheus.DefBuckets,
+	})
+	queueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "proto2json_queue_depth",
+		Help: "Current number of rows buffered in the dataList channel.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(linesTotal, decodeErrorsTotal, marshalErrorsTotal, writeErrorsTotal, bytesDecodedTotal, decodeDuration, marshalDuration, queueDepth)
+}
+
+// startMetricsServer serves the registered collectors on addr until the
+// process exits; it is only started when -metrics-addr is non-empty.
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); nil != err {
+			panic(err)
+		}
+	}()
+}
+
+// watchQueueDepth periodically samples len(dataList) into the queueDepth
+// gauge. It runs for the lifetime of the process; main does not wait on it.
+func watchQueueDepth(dataList chan *Data) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for range ticker.C {
+		queueDepth.Set(float64(len(dataList)))
+	}
+}
+
+// recordDecode wraps decodeFn (a decodeFuncs entry or GRPCInvoker.InvokeAll)
+// with a span carrying the line number and message name, and records the
+// decode-related metrics. decodeFn returns every message a row produced --
+// one for the csv/ndjson-hex/base64/delimited paths, possibly many for a
+// server-streaming RPC.
+func recordDecode(ctx context.Context, line uint32, msgName string, row []byte, decodeFn DecodeFunc) ([]proto.Message, error) {
+	_, span := tracer.Start(ctx, "proto2json.decode",
+		trace.WithAttributes(
+			attribute.Int64("proto2json.line", int64(line)),
+			attribute.String("proto2json.message", msgName),
+		))
+	defer span.End()
+
+	linesTotal.Inc()
+	start := time.Now()
+	msgs, err := decodeFn(row, msgName)
+	decodeDuration.Observe(time.Since(start).Seconds())
+	if nil != err {
+		decodeErrorsTotal.Inc()
+		span.RecordError(err)
+		return nil, err
+	}
+	var decodedBytes int
+	for _, msg := range msgs {
+		decodedBytes += proto.Size(msg)
+	}
+	bytesDecodedTotal.Add(float64(decodedBytes))
+	return msgs, nil
+}
+
+// recordMarshal wraps a Marshaler.Marshal call with a span and the marshal
+// latency histogram.
+func recordMarshal(ctx context.Context, line uint32, msgName string, marshal func() ([]byte, error)) ([]byte, error) {
+	_, span := tracer.Start(ctx, "proto2json.marshal",
+		trace.WithAttributes(
+			attribute.Int64("proto2json.line", int64(line)),
+			attribute.String("proto2json.message", msgName),
+		))
+	defer span.End()
+
+	start := time.Now()
+	out, err := marshal()
+	marshalDuration.Observe(time.Since(start).Seconds())
+	if nil != err {
+		marshalErrorsTotal.Inc()
+		span.RecordError(err)
+	}
+	return out, err
+}
+
+// recordWrite wraps a Writer.Write call with a span.
+func recordWrite(ctx context.Context, line uint32, write func() error) error {
+	_, span := tracer.Start(ctx, "proto2json.write",
+		trace.WithAttributes(attribute.Int64("proto2json.line", int64(line))))
+	defer span.End()
+
+	err := write()
+	if nil != err {
+		writeErrorsTotal.Inc()
+		span.RecordError(err)
+	}
+	return err
+}
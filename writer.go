@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/segmentio/kafka-go"
+)
+
+// KeyedWriter is implemented by writers that can honor a per-record
+// partition/shard key (currently only KafkaWriter). Callers that have a key
+// available (e.g. from a CSV column) should prefer WriteKeyed over Write
+// when the configured Writer supports it.
+type KeyedWriter interface {
+	Writer
+	WriteKeyed(key string, data []byte) error
+}
+
+// WriterConfig bundles every option the various writer factories need; each
+// factory reads only the fields relevant to it.
+type WriterConfig struct {
+	Dest              string
+	PartitionKeyField string
+	RotateMaxBytes    int64
+	RotateInterval    time.Duration
+	BatchMaxBytes     int
+	BatchInterval     time.Duration
+}
+
+// WriterFactory builds a Writer from a WriterConfig.
+type WriterFactory func(cfg WriterConfig) (Writer, error)
+
+var writerFactories = map[string]WriterFactory{}
+
+// RegisterWriterFactory adds name to the writer registry. Built-in writers
+// register themselves in this file's init; callers embedding this package
+// elsewhere could add their own.
+func RegisterWriterFactory(name string, factory WriterFactory) {
+	writerFactories[name] = factory
+}
+
+// NewWriter looks up name in the registry and builds a Writer from cfg.
+func NewWriter(name string, cfg WriterConfig) (Writer, error) {
+	factory, ok := writerFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("invalid writer name:%v", name)
+	}
+	return factory(cfg)
+}
+
+func init() {
+	RegisterWriterFactory("console", func(cfg WriterConfig) (Writer, error) {
+		return &ConsoleWriter{}, nil
+	})
+	RegisterWriterFactory("file", func(cfg WriterConfig) (Writer, error) {
+		w := &FileWriter{}
+		if err := w.OpenFile(cfg.Dest); nil != err {
+			return nil, err
+		}
+		return w, nil
+	})
+	RegisterWriterFactory("rotating-file", func(cfg WriterConfig) (Writer, error) {
+		return NewRotatingFileWriter(cfg.Dest, cfg.RotateMaxBytes, cfg.RotateInterval)
+	})
+	RegisterWriterFactory("kafka", func(cfg WriterConfig) (Writer, error) {
+		return NewKafkaWriter(cfg.Dest, cfg.PartitionKeyField)
+	})
+	RegisterWriterFactory("s3", func(cfg WriterConfig) (Writer, error) {
+		return NewS3Writer(cfg.Dest, cfg.BatchMaxBytes, cfg.BatchInterval)
+	})
+}
+
+// RotatingFileWriter is a FileWriter that rotates onto a fresh file once
+// maxBytes has been written or rotateEvery has elapsed since the current
+// file was opened, whichever comes first. Rotated segments are gzipped in
+// the background so rotation never blocks writers.
+type RotatingFileWriter struct {
+	mutex       sync.Mutex
+	path        string
+	maxBytes    int64
+	rotateEvery time.Duration
+
+	file    *os.File
+	written int64
+	opened  time.Time
+
+	gzipWG sync.WaitGroup // tracks in-flight rotate() gzip goroutines; Close waits on it
+}
+
+func NewRotatingFileWriter(path string, maxBytes int64, rotateEvery time.Duration) (*RotatingFileWriter, error) {
+	w := &RotatingFileWriter{
+		path:        path,
+		maxBytes:    maxBytes,
+		rotateEvery: rotateEvery,
+	}
+	if err := w.open(); nil != err {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RotatingFileWriter) open() error {
+	f, err := os.Create(w.path)
+	if nil != err {
+		return err
+	}
+	w.file = f
+	w.written = 0
+	w.opened = time.Now()
+	return nil
+}
+
+func (w *RotatingFileWriter) needsRotation() bool {
+	if w.maxBytes > 0 && w.written >= w.maxBytes {
+		return true
+	}
+	if w.rotateEvery > 0 && time.Since(w.opened) >= w.rotateEvery {
+		return true
+	}
+	return false
+}
+
+func (w *RotatingFileWriter) Write(data []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.needsRotation() {
+		if err := w.rotate(); nil != err {
+			return err
+		}
+	}
+
+	n, err := w.file.Write(data)
+	w.written += int64(n)
+	if nil != err {
+		return err
+	}
+	if _, err := w.file.Write([]byte{'\n'}); nil != err {
+		return err
+	}
+	w.written++
+	return nil
+}
+
+// Close closes and gzips the currently open segment; it does not open a
+// replacement, since the writer is being shut down. It also waits for any
+// rotate() gzip goroutines still running from earlier segments, so a run
+// that rotated several times never exits with some of those segments still
+// sitting uncompressed next to the ones that happened to finish in time.
+func (w *RotatingFileWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.file.Close(); nil != err {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%d", w.path, w.opened.UnixNano())
+	if err := os.Rename(w.path, rotated); nil != err {
+		return err
+	}
+	gzipAndRemove(rotated)
+	w.gzipWG.Wait()
+	return nil
+}
+
+func (w *RotatingFileWriter) rotate() error {
+	if err := w.file.Close(); nil != err {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%d", w.path, w.opened.UnixNano())
+	if err := os.Rename(w.path, rotated); nil != err {
+		return err
+	}
+	w.gzipWG.Add(1)
+	go func() {
+		defer w.gzipWG.Done()
+		gzipAndRemove(rotated)
+	}()
+	return w.open()
+}
+
+func gzipAndRemove(path string) {
+	src, err := os.Open(path)
+	if nil != err {
+		return
+	}
+	defer src.Close()
+
+	dst, err := os.Create(path + ".gz")
+	if nil != err {
+		return
+	}
+	defer dst.Close()
+
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); nil != err {
+		gz.Close()
+		return
+	}
+	if err := gz.Close(); nil != err {
+		return
+	}
+	os.Remove(path)
+}
+
+// KafkaWriter publishes each marshaled record to a Kafka topic. dest is of
+// the form "broker1:9092,broker2:9092/topic". When partitionKeyField names a
+// CSV column, WriteKeyed is used by the caller instead of Write so that
+// related records land on the same partition.
+type KafkaWriter struct {
+	writer            *kafka.Writer
+	partitionKeyField string
+}
+
+func NewKafkaWriter(dest string, partitionKeyField string) (*KafkaWriter, error) {
+	idx := strings.LastIndex(dest, "/")
+	if idx < 0 {
+		return nil, fmt.Errorf("kafka writer dest %q must be brokers/topic", dest)
+	}
+	brokers := strings.Split(dest[:idx], ",")
+	topic := dest[idx+1:]
+	if 0 == len(topic) {
+		return nil, fmt.Errorf("kafka writer dest %q is missing a topic", dest)
+	}
+
+	return &KafkaWriter{
+		writer: &kafka.Writer{
+			Addr:                   kafka.TCP(brokers...),
+			Topic:                  topic,
+			Balancer:               &kafka.Hash{},
+			AllowAutoTopicCreation: false,
+		},
+		partitionKeyField: partitionKeyField,
+	}, nil
+}
+
+func (w *KafkaWriter) Write(data []byte) error {
+	return w.writer.WriteMessages(context.Background(), kafka.Message{Value: data})
+}
+
+func (w *KafkaWriter) WriteKeyed(key string, data []byte) error {
+	return w.writer.WriteMessages(context.Background(), kafka.Message{Key: []byte(key), Value: data})
+}
+
+// Close flushes any buffered messages and closes the underlying producer.
+func (w *KafkaWriter) Close() error {
+	return w.writer.Close()
+}
+
+// S3Writer batches records into newline-delimited JSON and uploads each
+// batch as one object once it reaches maxBatchBytes, and also on every tick
+// of a flushInterval ticker started when the writer is created. The ticker
+// is not reset by a size-triggered upload.
+type S3Writer struct {
+	mutex         sync.Mutex
+	client        *s3.Client
+	bucket        string
+	prefix        string
+	maxBatchBytes int
+	buf           bytes.Buffer
+	seq           int
+}
+
+func NewS3Writer(dest string, maxBatchBytes int, flushInterval time.Duration) (*S3Writer, error) {
+	idx := strings.Index(dest, "/")
+	bucket, prefix := dest, ""
+	if idx >= 0 {
+		bucket, prefix = dest[:idx], dest[idx+1:]
+	}
+	if 0 == len(bucket) {
+		return nil, fmt.Errorf("s3 writer dest %q is missing a bucket", dest)
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if nil != err {
+		return nil, err
+	}
+
+	w := &S3Writer{
+		client:        s3.NewFromConfig(cfg),
+		bucket:        bucket,
+		prefix:        prefix,
+		maxBatchBytes: maxBatchBytes,
+	}
+	if flushInterval > 0 {
+		go w.flushPeriodically(flushInterval)
+	}
+	return w, nil
+}
+
+func (w *S3Writer) Write(data []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.buf.Write(data)
+	w.buf.WriteByte('\n')
+	if w.maxBatchBytes > 0 && w.buf.Len() >= w.maxBatchBytes {
+		return w.flushLocked()
+	}
+	return nil
+}
+
+func (w *S3Writer) flushPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		w.mutex.Lock()
+		if w.buf.Len() > 0 {
+			_ = w.flushLocked()
+		}
+		w.mutex.Unlock()
+	}
+}
+
+// Close uploads whatever is left in the batch buffer. Runs whose total
+// output never reached maxBatchBytes or flushInterval would otherwise have
+// their last batch silently dropped when the process exits.
+func (w *S3Writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	return w.flushLocked()
+}
+
+func (w *S3Writer) flushLocked() error {
+	key := filepath.ToSlash(filepath.Join(w.prefix, strconv.FormatInt(time.Now().UnixNano(), 10)+".ndjson"))
+	body := bytes.NewReader(w.buf.Bytes())
+	_, err := w.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(w.bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	})
+	if nil != err {
+		return err
+	}
+	w.buf.Reset()
+	w.seq++
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRotatingFileWriterClose forces a few rotations with a tiny maxBytes so
+// rotate()'s background gzip goroutines are still racing when Close runs,
+// then checks none of the rotated segments are left uncompressed: Close
+// must wait for them, not just gzip the final segment synchronously.
+func TestRotatingFileWriterClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.ndjson")
+
+	w, err := NewRotatingFileWriter(path, 8, 0)
+	if nil != err {
+		t.Fatalf("NewRotatingFileWriter: %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := w.Write([]byte("some row of data")); nil != err {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := w.Close(); nil != err {
+		t.Fatalf("Close: %v", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if nil != err {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) != ".gz" {
+			t.Errorf("segment %q left uncompressed after Close", e.Name())
+		}
+	}
+}